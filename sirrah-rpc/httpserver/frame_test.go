@@ -0,0 +1,83 @@
+package httpserver
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWriteReadFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		reqID   uint64
+		kind    byte
+		payload []byte
+	}{
+		{"request with payload", 1, frameKindRequest, []byte("tx bytes")},
+		{"stdout result", 42, frameKindStdoutResult, []byte{0xde, 0xad, 0xbe, 0xef}},
+		{"stderr chunk", 42, frameKindStderrChunk, []byte("partial log line\n")},
+		{"empty stderr diagnostics", 42, frameKindStderrDiagnostics, nil},
+		{"cancel", 7, frameKindCancel, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, tt.reqID, tt.kind, tt.payload); err != nil {
+				t.Fatalf("writeFrame: %v", err)
+			}
+
+			gotID, gotKind, gotPayload, err := readFrame(&buf)
+			if err != nil {
+				t.Fatalf("readFrame: %v", err)
+			}
+			if gotID != tt.reqID {
+				t.Errorf("reqID = %d, want %d", gotID, tt.reqID)
+			}
+			if gotKind != tt.kind {
+				t.Errorf("kind = %d, want %d", gotKind, tt.kind)
+			}
+			if !bytes.Equal(gotPayload, tt.payload) {
+				t.Errorf("payload = %q, want %q", gotPayload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestReadFrameMultipleFramesInSequence(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, 1, frameKindStderrChunk, []byte("first")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	if err := writeFrame(&buf, 1, frameKindStderrDiagnostics, []byte("second")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	_, kind, payload, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame (1st): %v", err)
+	}
+	if kind != frameKindStderrChunk || string(payload) != "first" {
+		t.Errorf("1st frame = (kind=%d, payload=%q), want (kind=%d, payload=%q)", kind, payload, frameKindStderrChunk, "first")
+	}
+
+	_, kind, payload, err = readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame (2nd): %v", err)
+	}
+	if kind != frameKindStderrDiagnostics || string(payload) != "second" {
+		t.Errorf("2nd frame = (kind=%d, payload=%q), want (kind=%d, payload=%q)", kind, payload, frameKindStderrDiagnostics, "second")
+	}
+}
+
+func TestReadFrameTruncatedInput(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, 1, frameKindRequest, []byte("hello")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-2])
+	if _, _, _, err := readFrame(truncated); err != io.ErrUnexpectedEOF {
+		t.Errorf("readFrame(truncated) err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -1,175 +1,619 @@
 package httpserver
 
 import (
-	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"os/exec"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/flashbots/gramine-andromeda-revm/sirrah-rpc/jsonrpc"
 	"github.com/flashbots/gramine-andromeda-revm/sirrah-rpc/metrics"
 )
 
-type RevmService struct {
-	log        *slog.Logger
-	metricsSrv *metrics.MetricsServer
+// version is overridden via `-ldflags "-X .../httpserver.version=..."` in
+// release builds; suave_version reports whatever was baked in.
+var version = "dev"
+
+// Wire format for the sgx-revm IPC boundary, see protocol.md. Every frame is
+// a big-endian uint32 length prefix followed by that many bytes of body,
+// where the body is `uint64 reqID || uint8 kind || data`. reqID lets a
+// worker's reader match a response back to the request that produced it;
+// kind says which of the request/stdout/stderr chunk/stderr final/cancel
+// frames this is.
+const (
+	frameKindRequest byte = iota
+	frameKindStdoutResult
+	frameKindStderrChunk
+	frameKindStderrDiagnostics
+	frameKindCancel
+)
+
+const frameHeaderLen = 8 + 1 // reqID + kind
 
-	sgxRevmCmd *exec.Cmd
-	cmdLock    chan struct{}
+func writeFrame(w io.Writer, reqID uint64, kind byte, payload []byte) error {
+	header := make([]byte, 4+frameHeaderLen)
+	binary.BigEndian.PutUint32(header[0:4], uint32(frameHeaderLen+len(payload)))
+	binary.BigEndian.PutUint64(header[4:12], reqID)
+	header[12] = kind
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	_, err := w.Write(payload)
+	return err
 }
 
-func NewRevmService(log *slog.Logger, metricsSrv *metrics.MetricsServer) (*RevmService, error) {
-	cmd := exec.Command("gramine-sgx", "./sgx-revm")
-	cmd.Stdout = &bytes.Buffer{}
-	cmd.Stderr = &bytes.Buffer{}
-	if err := cmd.Start(); err != nil {
-		return nil, err
+func readFrame(r io.Reader) (reqID uint64, kind byte, payload []byte, err error) {
+	var lenBuf [4]byte
+	if _, err = io.ReadFull(r, lenBuf[:]); err != nil {
+		return 0, 0, nil, err
 	}
 
-	return &RevmService{log: log, metricsSrv: metricsSrv, sgxRevmCmd: cmd, cmdLock: make(chan struct{}, 1)}, nil
+	frameLen := binary.BigEndian.Uint32(lenBuf[:])
+	if frameLen < frameHeaderLen {
+		return 0, 0, nil, fmt.Errorf("frame too short: %d bytes", frameLen)
+	}
+
+	body := make([]byte, frameLen)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	reqID = binary.BigEndian.Uint64(body[0:8])
+	kind = body[8]
+	payload = body[frameHeaderLen:]
+	return reqID, kind, payload, nil
 }
 
-func (r *RevmService) ExecuteLocked(ctx context.Context, cb func()) error {
-	// TODO: monitor timeouts
-	m_wait := r.metricsSrv.Float64Histogram("revm_lock_wait", "Revm Lock wait duration", metrics.UomMicroseconds, metrics.RevmLockWaitDuration...)
-	m_timeout := r.metricsSrv.Float64Histogram("revm_lock_timeout", "Revm Lock timeout", metrics.UomMicroseconds, metrics.RevmLockWaitDuration...)
-	start := time.Now()
+// poolReadyThreshold is the minimum number of healthy workers required for
+// the service to report itself as ready. Below this, handleReadinessCheck
+// should start failing so the load balancer drains traffic away from us.
+const poolReadyThreshold = 1
 
-	select {
-	case r.cmdLock <- struct{}{}: // lock
-		m_wait.Record(ctx, float64(time.Since(start).Microseconds()))
-		cb()
-		<-r.cmdLock // unlock
-		return nil
-	case <-ctx.Done():
-		m_timeout.Record(context.Background(), float64(time.Since(start).Microseconds()))
-		return ctx.Err()
+// revmWorker wraps a single `gramine-sgx ./sgx-revm` subprocess. Every call
+// into the enclave must hold lock, since the stdin/stdout/stderr pipes are
+// not safe for concurrent use.
+type revmWorker struct {
+	id  int
+	log *slog.Logger
+
+	lock sync.Mutex
+	cmd  *exec.Cmd
+
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+func newRevmWorker(id int, log *slog.Logger) (*revmWorker, error) {
+	w := &revmWorker{id: id, log: log.With("worker", id)}
+	if err := w.start(); err != nil {
+		return nil, err
 	}
+	return w, nil
 }
 
-func (r *RevmService) ExecuteTx(ctx context.Context, tx *types.Transaction) ([]byte, []byte, error) {
-	inPipe, err := r.sgxRevmCmd.StdinPipe()
+// start spawns the enclave subprocess and wires up its framed pipes. Caller
+// must hold w.lock.
+func (w *revmWorker) start() error {
+	cmd := exec.Command("gramine-sgx", "./sgx-revm")
+
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-
-	outPipe, err := r.sgxRevmCmd.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-
-	errPipe, err := r.sgxRevmCmd.StderrPipe()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	txBytes, err := tx.MarshalBinary()
-	if err != nil {
-		return nil, nil, err
+	if err := cmd.Start(); err != nil {
+		return err
 	}
 
-	txBytes = append(txBytes, []byte{'\n'}...)
-	_, err = inPipe.Write(txBytes)
-	if err != nil {
-		return nil, nil, err
+	w.cmd = cmd
+	w.stdin = stdin
+	w.stdout = stdout
+	w.stderr = stderr
+	return nil
+}
+
+// cancelGracePeriod bounds how long call waits for the enclave to ack a
+// cancel frame before giving up on it as unresponsive.
+const cancelGracePeriod = 5 * time.Second
+
+// errWorkerUnresponsive marks a worker that didn't reply within
+// cancelGracePeriod after a cancel frame and was killed outright. Callers
+// must not return a worker to the free pool on this error - it is no
+// longer owned by call, superviseWorker will pick it up once cmd.Wait
+// unblocks and re-add it to the pool after a successful restart.
+var errWorkerUnresponsive = errors.New("revm worker unresponsive after cancel")
+
+// errWorkerDesynced marks a worker whose cancel frame either couldn't be
+// written or wasn't acked cleanly - the enclave may still be alive, but its
+// stdin/stdout framing can no longer be trusted to line up with reqIDs.
+// Callers must not return a worker to the free pool on this error; it is
+// still this call's responsibility to kill it so superviseWorker restarts
+// it fresh.
+var errWorkerDesynced = errors.New("revm worker frame stream desynchronized after cancel")
+
+// call sends txBytes to the enclave as reqID and waits for the matching
+// stdout/stderr frames, invoking onStderrChunk (if non-nil) as each
+// non-empty stderr frame for reqID arrives so a subscriber sees diagnostics
+// live instead of only once the whole call has finished. If ctx is
+// cancelled first, a cancel frame is sent for reqID and call keeps blocking
+// (holding lock) for the enclave's reply for up to cancelGracePeriod, so
+// the worker is never handed back out mid-response; if no reply arrives in
+// that time, call kills the worker process and returns
+// errWorkerUnresponsive. Caller must not hold w.lock.
+func (w *revmWorker) call(ctx context.Context, reqID uint64, txBytes []byte, onStderrChunk func(chunk []byte)) ([]byte, []byte, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := writeFrame(w.stdin, reqID, frameKindRequest, txBytes); err != nil {
+		return nil, nil, fmt.Errorf("worker %d: writing request frame: %w", w.id, err)
 	}
 
-	outData := make([]byte, 0)
-	for {
-		var buf [1024]byte
-		nRead, err := outPipe.Read(buf[:])
+	type result struct {
+		stdout, stderr []byte
+		err            error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stdout, err := w.readMatchingFrame(w.stdout, reqID, frameKindStdoutResult)
 		if err != nil {
-			// TODO: how to recover? Could be impossible at this point. Simply panic and trigger a reboot.
-			r.log.Error("revm service stdout corrupted, cannot recover", "err", err)
-			panic(err)
+			done <- result{err: err}
+			return
 		}
-		if nRead == 0 {
-			time.Sleep(time.Microsecond)
+		stderr, err := w.readStderrStream(reqID, onStderrChunk)
+		done <- result{stdout: stdout, stderr: stderr, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.stdout, res.stderr, res.err
+	case <-ctx.Done():
+		if err := writeFrame(w.stdin, reqID, frameKindCancel, nil); err != nil {
+			return nil, nil, fmt.Errorf("%w: worker %d: writing cancel frame: %w", errWorkerDesynced, w.id, err)
 		}
-		outData = append(outData, buf[:nRead]...)
-		if buf[nRead-1] == '\n' {
-			break
+		select {
+		case res := <-done:
+			if res.err != nil {
+				return nil, nil, fmt.Errorf("%w: worker %d: after cancel: %w", errWorkerDesynced, w.id, res.err)
+			}
+			return nil, nil, ctx.Err()
+		case <-time.After(cancelGracePeriod):
+			// The enclave hasn't exited (superviseWorker would otherwise
+			// have restarted it) but also isn't acking the cancel - kill it
+			// outright rather than leaking this worker out of the pool
+			// forever.
+			w.cmd.Process.Kill()
+			return nil, nil, fmt.Errorf("%w: worker %d, waited %s", errWorkerUnresponsive, w.id, cancelGracePeriod)
 		}
 	}
+}
+
+func (w *revmWorker) readMatchingFrame(r io.Reader, reqID uint64, wantKind byte) ([]byte, error) {
+	gotID, kind, payload, err := readFrame(r)
+	if err != nil {
+		return nil, fmt.Errorf("worker %d: reading frame: %w", w.id, err)
+	}
+	if gotID != reqID || kind != wantKind {
+		return nil, fmt.Errorf("worker %d: frame mismatch: got req=%d kind=%d, want req=%d kind=%d", w.id, gotID, kind, reqID, wantKind)
+	}
+	return payload, nil
+}
 
-	outErr := make([]byte, 0)
+// readStderrStream reads reqID's stderr frames one at a time, invoking
+// onChunk (if non-nil) with each frame's payload as it arrives. The stream
+// for reqID ends at the first frameKindStderrDiagnostics frame, whose
+// payload (if any) is delivered as the final chunk; readStderrStream
+// returns the full concatenated stderr once it sees that frame.
+func (w *revmWorker) readStderrStream(reqID uint64, onChunk func(chunk []byte)) ([]byte, error) {
+	var all []byte
 	for {
-		var buf [1024]byte
-		nRead, err := errPipe.Read(buf[:])
+		gotID, kind, payload, err := readFrame(w.stderr)
 		if err != nil {
-			r.log.Error("revm service stdout corrupted, cannot recover", "err", err)
-			panic(err)
+			return nil, fmt.Errorf("worker %d: reading stderr frame: %w", w.id, err)
 		}
-		if nRead == 0 {
-			time.Sleep(time.Microsecond)
+		if gotID != reqID || (kind != frameKindStderrChunk && kind != frameKindStderrDiagnostics) {
+			return nil, fmt.Errorf("worker %d: frame mismatch: got req=%d kind=%d, want req=%d kind=%d or %d", w.id, gotID, kind, reqID, frameKindStderrChunk, frameKindStderrDiagnostics)
 		}
-		outErr = append(outErr, buf[:nRead]...)
-		if buf[nRead-1] == '\n' {
+
+		if len(payload) > 0 {
+			all = append(all, payload...)
+			if onChunk != nil {
+				onChunk(payload)
+			}
+		}
+		if kind == frameKindStderrDiagnostics {
+			return all, nil
+		}
+	}
+}
+
+type RevmService struct {
+	log        *slog.Logger
+	metricsSrv *metrics.MetricsServer
+
+	onHealthChange func(healthy bool)
+
+	workers []*revmWorker
+	free    chan *revmWorker
+
+	healthyWorkers atomic.Int64
+	nextReqID      atomic.Uint64
+
+	execLogMu        sync.Mutex
+	execLogListeners map[uint64]*execLogListener
+	nextListenerID   atomic.Uint64
+
+	// waitMetric, occupancyMetric and poolBacklogMetric are built once so
+	// ExecuteTx - the hottest path in this package, run once per
+	// transaction - doesn't register a fresh histogram on every call.
+	waitMetric        jsonrpc.Recorder
+	occupancyMetric   jsonrpc.Recorder
+	poolBacklogMetric jsonrpc.Recorder
+
+	// waiters counts ExecuteTx calls currently blocked waiting for a free
+	// worker, for poolBacklogMetric. This is a pool-wide count, not a
+	// per-worker one - there is no per-worker queue, since any waiter can
+	// be served by whichever worker becomes free first.
+	waiters atomic.Int64
+}
+
+// NewRevmService spawns poolSize supervised sgx-revm workers and returns a
+// service that load-balances ExecuteTx calls across whichever ones are idle.
+// onHealthChange, if non-nil, is invoked whenever the number of healthy
+// workers crosses poolReadyThreshold, so callers can wire it into a
+// readiness probe.
+func NewRevmService(log *slog.Logger, metricsSrv *metrics.MetricsServer, poolSize int, onHealthChange func(healthy bool)) (*RevmService, error) {
+	if poolSize < 1 {
+		return nil, fmt.Errorf("pool size must be at least 1, got %d", poolSize)
+	}
+
+	r := &RevmService{
+		log:               log,
+		metricsSrv:        metricsSrv,
+		onHealthChange:    onHealthChange,
+		workers:           make([]*revmWorker, 0, poolSize),
+		free:              make(chan *revmWorker, poolSize),
+		execLogListeners:  make(map[uint64]*execLogListener),
+		waitMetric:        metricsSrv.Float64Histogram("revm_pool_wait_duration", "Time spent waiting for an idle revm worker", metrics.UomMicroseconds, metrics.RevmLockWaitDuration...),
+		occupancyMetric:   metricsSrv.Float64Histogram("revm_pool_occupancy", "Number of revm workers currently busy", metrics.UomCount, metrics.BucketsSmallCount...),
+		poolBacklogMetric: metricsSrv.Float64Histogram("revm_pool_backlog", "Pool-wide count of ExecuteTx calls queued waiting for any idle revm worker (not per-worker)", metrics.UomCount, metrics.BucketsSmallCount...),
+	}
+
+	for i := 0; i < poolSize; i++ {
+		w, err := newRevmWorker(i, log)
+		if err != nil {
+			return nil, fmt.Errorf("starting worker %d: %w", i, err)
+		}
+		r.workers = append(r.workers, w)
+		r.free <- w
+		r.healthyWorkers.Add(1)
+	}
+	r.reportHealth()
+
+	for _, w := range r.workers {
+		go r.superviseWorker(w)
+	}
+
+	return r, nil
+}
+
+func (r *RevmService) reportHealth() {
+	if r.onHealthChange == nil {
+		return
+	}
+	r.onHealthChange(r.healthyWorkers.Load() >= poolReadyThreshold)
+}
+
+// superviseWorker blocks on the worker's subprocess exiting and restarts it
+// in place, keeping it out of the free list (and out of the healthy count)
+// for the duration of the restart.
+func (r *RevmService) superviseWorker(w *revmWorker) {
+	m_restarts := r.metricsSrv.Float64Histogram("revm_worker_restarts", "Revm worker restart count", metrics.UomCount, metrics.BucketsSmallCount...)
+
+	for {
+		w.lock.Lock()
+		cmd := w.cmd
+		w.lock.Unlock()
+
+		err := cmd.Wait()
+		r.log.Error("revm worker exited, restarting", "worker", w.id, "err", err)
+		r.healthyWorkers.Add(-1)
+		r.reportHealth()
+
+		w.lock.Lock()
+		for {
+			if startErr := w.start(); startErr != nil {
+				r.log.Error("failed to restart revm worker", "worker", w.id, "err", startErr)
+				time.Sleep(time.Second)
+				continue
+			}
 			break
 		}
+		w.lock.Unlock()
+
+		m_restarts.Record(context.Background(), 1)
+		r.healthyWorkers.Add(1)
+		r.reportHealth()
+		r.free <- w
 	}
+}
+
+// ExecuteTx dispatches tx to the first idle worker in the pool, blocking
+// until one is free or ctx is cancelled. onReqID, if non-nil, is invoked
+// with the reqID this call was assigned before any request frame is
+// written to the worker - in time for a caller that also scopes execLogs
+// subscriptions (see wsConn) to register interest in this reqID before the
+// enclave could have emitted a single stderr chunk for it.
+func (r *RevmService) ExecuteTx(ctx context.Context, tx *types.Transaction, onReqID func(reqID uint64)) ([]byte, []byte, error) {
+	start := time.Now()
 
-	return outData, outErr, nil
+	depth := r.waiters.Add(1)
+	r.poolBacklogMetric.Record(ctx, float64(depth))
+
+	var w *revmWorker
+	select {
+	case w = <-r.free:
+		r.waitMetric.Record(ctx, float64(time.Since(start).Microseconds()))
+	case <-ctx.Done():
+		r.waiters.Add(-1)
+		return nil, nil, ctx.Err()
+	}
+	r.waiters.Add(-1)
+
+	r.occupancyMetric.Record(ctx, float64(len(r.workers)-len(r.free)))
+
+	txBytes, err := tx.MarshalBinary()
+	if err != nil {
+		r.free <- w
+		return nil, nil, err
+	}
+
+	reqID := r.nextReqID.Add(1)
+	if onReqID != nil {
+		onReqID(reqID)
+	}
+	stdout, stderr, err := w.call(ctx, reqID, txBytes, func(chunk []byte) {
+		r.publishExecLog(reqID, chunk)
+	})
+
+	if errors.Is(err, errWorkerUnresponsive) {
+		// call already killed the worker itself; it's no longer ours to
+		// hand back; superviseWorker will re-add it to r.free once it has
+		// been restarted.
+		jsonrpc.LoggerFromContext(ctx, r.log).Error("revm worker unresponsive, killed for restart", "worker", w.id, "err", err)
+		return nil, nil, err
+	}
+
+	if errors.Is(err, errWorkerDesynced) {
+		// The cancel handshake itself failed or came back dirty; the
+		// worker's frame stream can't be trusted to line up with reqIDs
+		// any more, so it can't go back in the free pool even though ctx
+		// being cancelled would otherwise make this look like "our" error.
+		jsonrpc.LoggerFromContext(ctx, r.log).Error("revm worker desynchronized after cancel, killing for restart", "worker", w.id, "err", err)
+		w.lock.Lock()
+		w.cmd.Process.Kill()
+		w.lock.Unlock()
+		return nil, nil, err
+	}
+
+	if err != nil && ctx.Err() == nil {
+		// A real protocol/pipe error, not just our own cancellation; the
+		// framing is wedged, so kill the worker and let superviseWorker
+		// restart it rather than handing a broken worker back out.
+		jsonrpc.LoggerFromContext(ctx, r.log).Error("revm worker call failed, killing for restart", "worker", w.id, "err", err)
+		w.lock.Lock()
+		w.cmd.Process.Kill()
+		w.lock.Unlock()
+		return nil, nil, err
+	}
+
+	r.free <- w
+	return stdout, stderr, err
 }
 
-type JsonRpcRequest struct {
-	Jsonrpc string          `json:"jsonrpc"`
-	Method  string          `json:"method"`
-	Params  json.RawMessage `json:"params,omitempty"`
-	Id      interface{}     `json:"id"`
+// execLogListenerQueueDepth bounds how far a slow execLogs subscriber can
+// fall behind before publishExecLog starts dropping chunks for it, rather
+// than block the enclave stderr reader on a stuck websocket write.
+const execLogListenerQueueDepth = 64
+
+type execLogChunk struct {
+	reqID  uint64
+	stderr []byte
+}
+
+// execLogListener delivers chunks to a single execLogs subscriber in the
+// order publishExecLog enqueued them. fn is called from a dedicated
+// goroutine so a slow subscriber only ever blocks its own queue, but that
+// goroutine is exactly why delivery stays ordered: unlike firing `go
+// fn(...)` per chunk, there's only ever one in-flight call to fn.
+type execLogListener struct {
+	fn   func(reqID uint64, stderr []byte)
+	in   chan execLogChunk
+	done chan struct{}
+}
+
+func newExecLogListener(fn func(reqID uint64, stderr []byte)) *execLogListener {
+	l := &execLogListener{fn: fn, in: make(chan execLogChunk, execLogListenerQueueDepth), done: make(chan struct{})}
+	go l.run()
+	return l
+}
+
+func (l *execLogListener) run() {
+	for {
+		select {
+		case c := <-l.in:
+			l.fn(c.reqID, c.stderr)
+		case <-l.done:
+			return
+		}
+	}
 }
 
-type JsonRpcError struct {
-	Code    int    `json:"code"`
-	Message string `json:message""`
+// publish enqueues a chunk for delivery, dropping it if the listener is
+// too far behind rather than blocking the caller (publishExecLog, called
+// from the enclave stderr reader).
+func (l *execLogListener) publish(reqID uint64, stderr []byte) {
+	select {
+	case l.in <- execLogChunk{reqID: reqID, stderr: stderr}:
+	default:
+	}
+}
+
+func (l *execLogListener) stop() {
+	close(l.done)
 }
 
-type JsonRpcErrorResponse struct {
-	Jsonrpc string       `json:"jsonrpc"`
-	Error   JsonRpcError `json:"error"`
-	Id      interface{}  `json:"id"`
+// subscribeExecLogs registers fn to be called with each chunk of stderr
+// diagnostics as an in-flight ExecuteTx call produces it, until the
+// returned cancel func is invoked. fn may be called multiple times per
+// reqID, once per non-empty stderr frame the enclave emits, including the
+// final one; a frame with an empty payload produces no call. Calls for a
+// given reqID are delivered in the order the enclave emitted them, but a
+// chunk is dropped for this fn if execLogListenerQueueDepth chunks are
+// already waiting to be delivered to it.
+func (r *RevmService) subscribeExecLogs(fn func(reqID uint64, stderr []byte)) (cancel func()) {
+	id := r.nextListenerID.Add(1)
+	l := newExecLogListener(fn)
+	r.execLogMu.Lock()
+	r.execLogListeners[id] = l
+	r.execLogMu.Unlock()
+	return func() {
+		r.execLogMu.Lock()
+		delete(r.execLogListeners, id)
+		r.execLogMu.Unlock()
+		l.stop()
+	}
 }
 
-func NewJsonRpcErrorResponse(r *JsonRpcRequest, code int, msg string) JsonRpcErrorResponse {
-	return JsonRpcErrorResponse{
-		Id:      r.Id,
-		Error:   JsonRpcError{Code: code, Message: msg},
-		Jsonrpc: r.Jsonrpc,
+// publishExecLog fans a single stderr chunk for reqID out to every
+// execLogs subscriber; call once per chunk as it arrives, not once per
+// ExecuteTx call.
+func (r *RevmService) publishExecLog(reqID uint64, stderr []byte) {
+	r.execLogMu.Lock()
+	defer r.execLogMu.Unlock()
+	for _, l := range r.execLogListeners {
+		l.publish(reqID, stderr)
 	}
 }
 
-type JsonRpcSuccessResponse struct {
-	Jsonrpc string      `json:"jsonrpc"`
-	Result  interface{} `json:"result"`
-	Id      interface{} `json:"id"`
+// newJsonRpcServer builds the method registry for the public API. It is
+// cheap to construct (a handful of map inserts), so handleAPI just builds
+// one per request rather than threading it through Server's constructor.
+func newJsonRpcServer(s *Server) *jsonrpc.Server {
+	rpc := jsonrpc.NewServer(s.log, s.metricsSrv)
+	rpc.Register("suave_offchainCall", s.handleOffchainCall)
+	rpc.Register("suave_version", s.handleVersion)
+	rpc.Register("suave_health", s.handleHealth)
+	rpc.Register("suave_attestation", s.handleAttestation)
+	return rpc
+}
+
+// offchainCallResult is the suave_offchainCall response. ReqID is the
+// value execLogs chunks for this call carry, so a caller that also
+// subscribes to execLogs over the same websocket connection knows which
+// notifications are its own.
+type offchainCallResult struct {
+	ReqID  uint64        `json:"reqId"`
+	Result hexutil.Bytes `json:"result"`
+}
+
+// executeOffchainCall unmarshals params as a transaction and dispatches it
+// through revmService.ExecuteTx. onReqID, if non-nil, is forwarded to
+// ExecuteTx so a caller that needs to know the reqID before the call
+// starts executing (wsConn, to scope execLogs delivery) can get it.
+func (s *Server) executeOffchainCall(ctx context.Context, params json.RawMessage, onReqID func(reqID uint64)) (offchainCallResult, *jsonrpc.Error) {
+	var tx types.Transaction
+	if err := json.Unmarshal(params, &tx); err != nil {
+		return offchainCallResult{}, jsonrpc.NewError(jsonrpc.CodeInvalidParams, fmt.Sprintf("could not unmarshal transaction: %s", err.Error()))
+	}
+
+	// Probably some more checks go here (signature is optional!)
+
+	log := jsonrpc.LoggerFromContext(ctx, s.log)
+
+	var reqID uint64
+	stdout, stderr, err := s.revmService.ExecuteTx(ctx, &tx, func(id uint64) {
+		reqID = id
+		if onReqID != nil {
+			onReqID(id)
+		}
+	})
+	if err != nil {
+		log.Error("could not execute offchain call", "err", err)
+		return offchainCallResult{ReqID: reqID}, jsonrpc.NewError(jsonrpc.CodeInternalError, fmt.Sprintf("could not execute: %s", err.Error()))
+	}
+
+	if len(stderr) > 0 {
+		log.Info("encountered execution error", "errData", stderr)
+	}
+
+	return offchainCallResult{ReqID: reqID, Result: stdout}, nil
 }
 
-func NewJsonRpcSuccessResponse(r *JsonRpcRequest, data interface{}) JsonRpcSuccessResponse {
-	return JsonRpcSuccessResponse{
-		Id:      r.Id,
-		Result:  data,
-		Jsonrpc: r.Jsonrpc,
+func (s *Server) handleOffchainCall(ctx context.Context, params json.RawMessage) (any, *jsonrpc.Error) {
+	res, rpcErr := s.executeOffchainCall(ctx, params, nil)
+	if rpcErr != nil {
+		return nil, rpcErr
 	}
+	return res, nil
 }
 
-func parseJsonRpcRequest(r *http.Request) (*JsonRpcRequest, error) {
-	var req JsonRpcRequest
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&req)
+func (s *Server) handleVersion(ctx context.Context, params json.RawMessage) (any, *jsonrpc.Error) {
+	return version, nil
+}
+
+func (s *Server) handleHealth(ctx context.Context, params json.RawMessage) (any, *jsonrpc.Error) {
+	return map[string]bool{"ready": s.isReady.Load()}, nil
+}
+
+// readSGXQuote fetches the enclave's current SGX quote through Gramine's
+// pseudo-filesystem attestation interface.
+func readSGXQuote() ([]byte, error) {
+	return os.ReadFile("/dev/attestation/quote")
+}
+
+func (s *Server) handleAttestation(ctx context.Context, params json.RawMessage) (any, *jsonrpc.Error) {
+	quote, err := readSGXQuote()
 	if err != nil {
-		return nil, err
+		return nil, jsonrpc.NewError(jsonrpc.CodeInternalError, fmt.Sprintf("could not read sgx quote: %s", err.Error()))
 	}
-	return &req, nil
+	return hexutil.Encode(quote), nil
 }
 
-func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
-	// TODO: make logs traceable to a specific request!
+// codeExecutionTimeout is returned when a request doesn't finish processing
+// before the server's write timeout expires.
+const codeExecutionTimeout = -32001
+
+// writeTimeoutEpsilon is shaved off the configured write timeout so we have
+// time left to write the timeout response itself before the underlying
+// http.Server gives up on the connection.
+const writeTimeoutEpsilon = 50 * time.Millisecond
 
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
 	m := s.metricsSrv.Float64Histogram(
 		"request_duration_api",
 		"API request handling duration",
@@ -180,57 +624,80 @@ func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
 		m.Record(r.Context(), float64(time.Since(start).Microseconds()))
 	}(time.Now())
 
-	// TODO: implement this within a proper jsonrpc server
+	ctx, cancel := context.WithCancel(jsonrpc.WithIncomingTraceparent(r.Context(), r.Header.Get("traceparent")))
+	defer cancel()
+	tc, _ := jsonrpc.TraceContextFromContext(ctx)
 
-	jr, err := parseJsonRpcRequest(r)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("could not parse request: %s", err.Error())))
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-
-	if jr.Method != "suave_offchainCall" {
-		json.NewEncoder(w).Encode(NewJsonRpcErrorResponse(jr, -32600, "invalid method, expected suave_offchainCall"))
-		return
-	}
-
-	var tx types.Transaction
-	err = json.Unmarshal(jr.Params, &tx)
-	if err != nil {
-		json.NewEncoder(w).Encode(NewJsonRpcErrorResponse(jr, -32600, fmt.Sprintf("could not unmarshal transaction: %s", err.Error())))
-		return
-	}
+	var once sync.Once
+	done := make(chan struct{})
+	start := time.Now()
 
-	// Probably some more checks go here (signature is optional!)
+	go func() {
+		defer close(done)
 
-	ctx := r.Context()
-	outCh := make(chan []byte, 2)
-	errCh := make(chan error, 1)
-	s.revmService.ExecuteLocked(ctx, func() {
-		stdout, stderr, err := s.revmService.ExecuteTx(ctx, &tx)
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			errCh <- err
+			once.Do(func() {
+				w.Header().Set("traceparent", tc.Traceparent())
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("could not read request body: %s", err.Error())))
+			})
 			return
 		}
 
-		outCh <- stdout
-		outCh <- stderr
-		errCh <- nil
-	})
+		resp := newJsonRpcServer(s).Handle(ctx, body)
+		once.Do(func() {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("traceparent", tc.Traceparent())
+			if resp == nil {
+				// The request (or every request in a batch) was a notification.
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Write(resp)
+		})
+	}()
+
+	budget := s.cfg.WriteTimeout - writeTimeoutEpsilon
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
 
-	if err = <-errCh; err != nil {
-		s.log.Error("could not execute offchain call", "err", err)
-		json.NewEncoder(w).Encode(NewJsonRpcErrorResponse(jr, -32600, fmt.Sprintf("could not execute: %s", err.Error())))
-		return
+	select {
+	case <-done:
+	case <-timer.C:
+		// Cancel so ExecuteTx/the worker call unwind and the worker gets
+		// reclaimed instead of being held by a client that already gave up.
+		cancel()
+		once.Do(func() {
+			s.writeAPITimeout(w, tc, time.Since(start))
+		})
 	}
+}
 
-	json.NewEncoder(w).Encode(NewJsonRpcSuccessResponse(jr, <-outCh))
-
-	if errData := <-errCh; errData != nil {
-		s.log.Info("encountered execution error", "errData", errData)
+// writeAPITimeout emits a JSON-RPC error for a request that didn't finish
+// before the write-timeout budget ran out. Content-Length is set explicitly
+// (disabling chunked encoding) and callers must not run compression
+// middleware ahead of this handler, so the client gets a complete,
+// parseable body instead of a connection reset mid-stream.
+func (s *Server) writeAPITimeout(w http.ResponseWriter, tc jsonrpc.TraceContext, elapsed time.Duration) {
+	resp := jsonrpc.Response{
+		Jsonrpc: "2.0",
+		Error: &jsonrpc.Error{
+			Code:    codeExecutionTimeout,
+			Message: fmt.Sprintf("execution timeout after %s", elapsed),
+		},
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		body = []byte(`{"jsonrpc":"2.0","error":{"code":-32603,"message":"internal error"}}`)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("traceparent", tc.Traceparent())
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusGatewayTimeout)
+	w.Write(body)
 }
 
 func (s *Server) handleLivenessCheck(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,308 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gorilla/websocket"
+
+	"github.com/flashbots/gramine-andromeda-revm/sirrah-rpc/jsonrpc"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+type subscribeParams struct {
+	Topic string `json:"topic"`
+}
+
+type subscriptionNotification struct {
+	Jsonrpc string                   `json:"jsonrpc"`
+	Method  string                   `json:"method"`
+	Params  subscriptionNotifyParams `json:"params"`
+}
+
+type subscriptionNotifyParams struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result"`
+}
+
+func newSubID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "0x" + hex.EncodeToString(b)
+}
+
+// wsConn owns the subscriptions created over a single websocket connection.
+// All of them are torn down when the connection closes, so a client never
+// leaks a subscription by just dropping off. It also tracks the reqIDs of
+// suave_offchainCall requests this same connection has issued, so an
+// execLogs subscription on this connection only ever sees chunks for its
+// own calls, never another client's in-flight transactions.
+type wsConn struct {
+	server *Server
+	conn   *websocket.Conn
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	subs      map[string]func()
+	ownedReqs map[uint64]struct{}
+}
+
+func newWSConn(s *Server, conn *websocket.Conn) *wsConn {
+	return &wsConn{server: s, conn: conn, subs: make(map[string]func()), ownedReqs: make(map[uint64]struct{})}
+}
+
+// addOwnedReqID records reqID as belonging to a suave_offchainCall this
+// connection issued, passed as RevmService.ExecuteTx's onReqID callback so
+// it runs before the call starts executing - no execLogs chunk for reqID
+// can be published before this connection is allowed to see it.
+func (c *wsConn) addOwnedReqID(reqID uint64) {
+	c.mu.Lock()
+	c.ownedReqs[reqID] = struct{}{}
+	c.mu.Unlock()
+}
+
+// removeOwnedReqID drops reqID once its suave_offchainCall has returned,
+// since ExecuteTx only returns after the enclave's full stderr stream for
+// that reqID has already been delivered; keeping it around past that point
+// would just leak memory over the life of a long-running connection.
+func (c *wsConn) removeOwnedReqID(reqID uint64) {
+	c.mu.Lock()
+	delete(c.ownedReqs, reqID)
+	c.mu.Unlock()
+}
+
+func (c *wsConn) ownsReqID(reqID uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.ownedReqs[reqID]
+	return ok
+}
+
+// handleOffchainCall wraps Server.executeOffchainCall to additionally
+// register/release reqID ownership for this connection, so its execLogs
+// subscriptions (see handleSubscribe) are scoped to its own calls.
+func (c *wsConn) handleOffchainCall(ctx context.Context, params json.RawMessage) (any, *jsonrpc.Error) {
+	var reqID uint64
+	res, rpcErr := c.server.executeOffchainCall(ctx, params, func(id uint64) {
+		reqID = id
+		c.addOwnedReqID(id)
+	})
+	defer c.removeOwnedReqID(reqID)
+	return res, rpcErr
+}
+
+func (c *wsConn) write(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteJSON(v)
+}
+
+// writeRaw sends an already-encoded JSON-RPC response frame, guarded by the
+// same mutex as write so it never interleaves with a subscription
+// notification on the wire.
+func (c *wsConn) writeRaw(raw []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, raw)
+}
+
+func (c *wsConn) notify(subID string, result interface{}) {
+	if err := c.write(subscriptionNotification{
+		Jsonrpc: "2.0",
+		Method:  "suave_subscription",
+		Params:  subscriptionNotifyParams{Subscription: subID, Result: result},
+	}); err != nil {
+		c.server.log.Error("could not deliver subscription notification", "subscription", subID, "err", err)
+	}
+}
+
+func (c *wsConn) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, cancel := range c.subs {
+		cancel()
+		delete(c.subs, id)
+	}
+}
+
+func (c *wsConn) handleSubscribe(ctx context.Context, params json.RawMessage) (any, *jsonrpc.Error) {
+	if !c.server.isReady.Load() {
+		return nil, jsonrpc.NewError(jsonrpc.CodeInternalError, "server is draining, not accepting new subscriptions")
+	}
+
+	var p subscribeParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, jsonrpc.NewError(jsonrpc.CodeInvalidParams, fmt.Sprintf("could not unmarshal subscribe params: %s", err.Error()))
+	}
+
+	subID := newSubID()
+
+	var cancel func()
+	switch p.Topic {
+	case "execLogs":
+		cancel = c.server.revmService.subscribeExecLogs(func(reqID uint64, stderr []byte) {
+			// Scope delivery to reqIDs this connection's own
+			// suave_offchainCall calls produced - execLogs otherwise
+			// carries another client's confidential off-chain execution
+			// trace, which would defeat the whole point of running inside
+			// an SGX enclave.
+			if !c.ownsReqID(reqID) {
+				return
+			}
+			c.notify(subID, map[string]interface{}{"reqId": reqID, "stderr": hexutil.Bytes(stderr)})
+		})
+	case "newEnclaveQuote":
+		enclaveQuoteWatcher.ensureStarted(c.server.log)
+		cancel = enclaveQuoteWatcher.subscribe(func(quote []byte) {
+			c.notify(subID, hexutil.Encode(quote))
+		})
+	default:
+		return nil, jsonrpc.NewError(jsonrpc.CodeInvalidParams, fmt.Sprintf("unknown subscription topic: %s", p.Topic))
+	}
+
+	c.mu.Lock()
+	c.subs[subID] = cancel
+	c.mu.Unlock()
+
+	return subID, nil
+}
+
+func (c *wsConn) handleUnsubscribe(ctx context.Context, params json.RawMessage) (any, *jsonrpc.Error) {
+	var subID string
+	if err := json.Unmarshal(params, &subID); err != nil {
+		return nil, jsonrpc.NewError(jsonrpc.CodeInvalidParams, fmt.Sprintf("could not unmarshal subscription id: %s", err.Error()))
+	}
+
+	c.mu.Lock()
+	cancel, ok := c.subs[subID]
+	delete(c.subs, subID)
+	c.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	cancel()
+	return true, nil
+}
+
+// handleWS upgrades the connection and runs the same JSON-RPC dispatcher as
+// handleAPI, plus suave_subscribe/suave_unsubscribe for this connection.
+// suave_offchainCall is re-registered against wsc.handleOffchainCall rather
+// than the package-level handler so calls made over this connection are
+// tracked against it for execLogs scoping; see wsConn.ownedReqs.
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Error("could not upgrade websocket connection", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	wsc := newWSConn(s, conn)
+	defer wsc.closeAll()
+
+	rpc := newJsonRpcServer(s)
+	rpc.Register("suave_subscribe", wsc.handleSubscribe)
+	rpc.Register("suave_unsubscribe", wsc.handleUnsubscribe)
+	rpc.Register("suave_offchainCall", wsc.handleOffchainCall)
+
+	ctx := jsonrpc.WithIncomingTraceparent(r.Context(), r.Header.Get("traceparent"))
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		resp := rpc.Handle(ctx, data)
+		if resp == nil {
+			continue
+		}
+		if err := wsc.writeRaw(resp); err != nil {
+			return
+		}
+	}
+}
+
+// quoteWatcher polls the enclave's SGX quote for rotation and fans out a
+// notification to every newEnclaveQuote subscriber across all connections
+// when it changes. It's a package-level singleton since the quote itself is
+// process-wide, not per-connection.
+type quoteWatcher struct {
+	startOnce sync.Once
+
+	mu        sync.Mutex
+	listeners map[uint64]func(quote []byte)
+	nextID    atomic.Uint64
+	lastHash  [32]byte
+	haveHash  bool
+}
+
+var enclaveQuoteWatcher = &quoteWatcher{listeners: make(map[uint64]func(quote []byte))}
+
+const quotePollInterval = 30 * time.Second
+
+func (q *quoteWatcher) subscribe(fn func(quote []byte)) func() {
+	id := q.nextID.Add(1)
+	q.mu.Lock()
+	q.listeners[id] = fn
+	q.mu.Unlock()
+	return func() {
+		q.mu.Lock()
+		delete(q.listeners, id)
+		q.mu.Unlock()
+	}
+}
+
+func (q *quoteWatcher) ensureStarted(log *slog.Logger) {
+	q.startOnce.Do(func() {
+		go q.run(log)
+	})
+}
+
+func (q *quoteWatcher) run(log *slog.Logger) {
+	ticker := time.NewTicker(quotePollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		quote, err := readSGXQuote()
+		if err != nil {
+			log.Error("could not poll sgx quote for rotation", "err", err)
+			continue
+		}
+		hash := sha256.Sum256(quote)
+
+		q.mu.Lock()
+		rotated := !q.haveHash || hash != q.lastHash
+		q.lastHash = hash
+		q.haveHash = true
+		listeners := make([]func(quote []byte), 0, len(q.listeners))
+		for _, fn := range q.listeners {
+			listeners = append(listeners, fn)
+		}
+		q.mu.Unlock()
+
+		if !rotated {
+			continue
+		}
+		for _, fn := range listeners {
+			go fn(quote)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Package jsonrpc implements a small JSON-RPC 2.0 dispatcher: a method
+// registry, batch-request support, notification handling, and the standard
+// error codes from the spec.
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/flashbots/gramine-andromeda-revm/sirrah-rpc/metrics"
+)
+
+// Standard JSON-RPC 2.0 error codes, see
+// https://www.jsonrpc.org/specification#error_object.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NewError(code int, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// Handler processes a single decoded JSON-RPC request. Returning a non-nil
+// *Error takes precedence over the result value, which is otherwise
+// marshalled into the response's "result" field.
+type Handler func(ctx context.Context, params json.RawMessage) (any, *Error)
+
+type Request struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      interface{}     `json:"id,omitempty"`
+}
+
+// isNotification reports whether req carries no id, per the spec meaning
+// the caller doesn't want a response.
+func (req *Request) isNotification() bool {
+	return req.Id == nil
+}
+
+type Response struct {
+	Jsonrpc string      `json:"jsonrpc"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *Error      `json:"error,omitempty"`
+	Id      interface{} `json:"id"`
+}
+
+// Server dispatches decoded JSON-RPC requests to registered Handlers.
+type Server struct {
+	handlers map[string]Handler
+
+	log     *slog.Logger
+	metrics *methodMetrics
+}
+
+func NewServer(log *slog.Logger, metricsSrv *metrics.MetricsServer) *Server {
+	return &Server{
+		handlers: make(map[string]Handler),
+		log:      log,
+		metrics:  newMethodMetrics(metricsSrv),
+	}
+}
+
+func (s *Server) Register(method string, h Handler) {
+	s.handlers[method] = h
+}
+
+// methodLabel returns method unchanged if it names a registered handler,
+// and "unknown" otherwise. Per-method metrics are labeled with this
+// instead of the raw request method so a client sending a stream of junk
+// method names can't grow methodMetrics.cache without bound - every
+// unregistered method collapses onto the one "unknown" instrument.
+func (s *Server) methodLabel(method string) string {
+	if _, ok := s.handlers[method]; ok {
+		return method
+	}
+	return "unknown"
+}
+
+// Handle decodes raw as either a single request object or a batch (a JSON
+// array of request objects), dispatches each to its registered handler, and
+// returns the bytes to write back to the caller. It returns nil if there is
+// nothing to write back, which happens when raw was a single notification,
+// or a batch made up entirely of notifications.
+func (s *Server) Handle(ctx context.Context, raw []byte) []byte {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 {
+		return encode(errorResponse(nil, CodeParseError, "empty request body"))
+	}
+
+	if trimmed[0] == '[' {
+		return s.handleBatch(ctx, trimmed)
+	}
+
+	var req Request
+	if err := json.Unmarshal(trimmed, &req); err != nil {
+		return encode(errorResponse(nil, CodeParseError, fmt.Sprintf("invalid request: %s", err.Error())))
+	}
+
+	resp := s.dispatch(ctx, &req)
+	if resp == nil {
+		return nil
+	}
+	return encode(*resp)
+}
+
+func (s *Server) handleBatch(ctx context.Context, raw []byte) []byte {
+	var reqs []Request
+	if err := json.Unmarshal(raw, &reqs); err != nil {
+		return encode(errorResponse(nil, CodeParseError, fmt.Sprintf("invalid batch: %s", err.Error())))
+	}
+	if len(reqs) == 0 {
+		return encode(errorResponse(nil, CodeInvalidRequest, "empty batch"))
+	}
+
+	responses := make([]Response, 0, len(reqs))
+	for i := range reqs {
+		if resp := s.dispatch(ctx, &reqs[i]); resp != nil {
+			responses = append(responses, *resp)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(responses)
+	if err != nil {
+		return encode(errorResponse(nil, CodeInternalError, fmt.Sprintf("could not marshal batch response: %s", err.Error())))
+	}
+	return data
+}
+
+// dispatch opens a span for req (tagged with rpc.method, rpc.id and
+// rpc.direction=server), attaches a request-scoped logger to ctx, and
+// records the per-method latency/size/error metrics around the handler
+// call. The span/logger/metrics setup runs before the request is even
+// validated or looked up, so an invalid request or unknown method still
+// gets a correlated trace_id/req_id logger and an rpc_server_errors count —
+// those are exactly the requests an operator most needs to find later.
+// Bodies that don't parse as JSON are answered by Handle/handleBatch
+// without reaching dispatch, so they get neither.
+// Metrics are labeled with methodLabel(req.Method), not the raw method, so
+// an attacker can't grow the metrics cache by sending junk method names;
+// the logger above still gets the raw method for correlation.
+func (s *Server) dispatch(ctx context.Context, req *Request) *Response {
+	tc, ok := TraceContextFromContext(ctx)
+	if !ok {
+		tc = NewTraceContext()
+	}
+	spanID := randomHex(8)
+
+	log := s.log
+	if log != nil {
+		log = log.With(
+			"trace_id", tc.TraceID,
+			"span_id", spanID,
+			"req_id", fmt.Sprint(req.Id),
+			"rpc.method", req.Method,
+			"rpc.direction", "server",
+		)
+		ctx = withLogger(ctx, log)
+	}
+
+	label := s.methodLabel(req.Method)
+
+	start := time.Now()
+	s.metrics.recordRequestBytes(label, float64(len(req.Params)))
+
+	if req.Jsonrpc != "2.0" || req.Method == "" {
+		if req.isNotification() {
+			return nil
+		}
+		s.metrics.recordError(label, CodeInvalidRequest)
+		return errorResponse(req.Id, CodeInvalidRequest, "invalid request")
+	}
+
+	h, ok := s.handlers[req.Method]
+	if !ok {
+		if req.isNotification() {
+			return nil
+		}
+		s.metrics.recordError(label, CodeMethodNotFound)
+		return errorResponse(req.Id, CodeMethodNotFound, fmt.Sprintf("method not found: %s", req.Method))
+	}
+
+	result, rpcErr := h(ctx, req.Params)
+
+	s.metrics.recordLatency(label, float64(time.Since(start).Microseconds()))
+	if rpcErr != nil && log != nil {
+		log.Error("jsonrpc handler returned an error", "code", rpcErr.Code, "message", rpcErr.Message)
+	}
+
+	if req.isNotification() {
+		return nil
+	}
+
+	if rpcErr != nil {
+		s.metrics.recordError(label, rpcErr.Code)
+		return &Response{Jsonrpc: "2.0", Error: rpcErr, Id: req.Id}
+	}
+
+	resp := &Response{Jsonrpc: "2.0", Result: result, Id: req.Id}
+	if respBytes, err := json.Marshal(resp.Result); err == nil {
+		s.metrics.recordResponseBytes(label, float64(len(respBytes)))
+	}
+	return resp
+}
+
+func errorResponse(id interface{}, code int, msg string) *Response {
+	return &Response{Jsonrpc: "2.0", Error: NewError(code, msg), Id: id}
+}
+
+func encode(resp Response) []byte {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		// Marshalling our own Response type should never fail.
+		return []byte(fmt.Sprintf(`{"jsonrpc":"2.0","error":{"code":%d,"message":%q}}`, CodeInternalError, err.Error()))
+	}
+	return data
+}
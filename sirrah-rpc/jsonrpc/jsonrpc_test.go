@@ -0,0 +1,151 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/flashbots/gramine-andromeda-revm/sirrah-rpc/metrics"
+)
+
+func newTestServer() *Server {
+	return NewServer(nil, &metrics.MetricsServer{})
+}
+
+func TestHandleSingleRequest(t *testing.T) {
+	s := newTestServer()
+	s.Register("echo", func(ctx context.Context, params json.RawMessage) (any, *Error) {
+		return string(params), nil
+	})
+
+	raw := []byte(`{"jsonrpc":"2.0","method":"echo","params":"hi","id":1}`)
+	got := s.Handle(context.Background(), raw)
+
+	var resp Response
+	if err := json.Unmarshal(got, &resp); err != nil {
+		t.Fatalf("unmarshalling response: %v", err)
+	}
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %+v", resp.Error)
+	}
+	if resp.Result != `"hi"` {
+		t.Errorf("result = %v, want %q", resp.Result, `"hi"`)
+	}
+}
+
+func TestHandleNotificationSuppressesResponse(t *testing.T) {
+	s := newTestServer()
+	called := false
+	s.Register("echo", func(ctx context.Context, params json.RawMessage) (any, *Error) {
+		called = true
+		return nil, nil
+	})
+
+	raw := []byte(`{"jsonrpc":"2.0","method":"echo","params":"hi"}`)
+	got := s.Handle(context.Background(), raw)
+
+	if got != nil {
+		t.Errorf("Handle(notification) = %q, want nil", got)
+	}
+	if !called {
+		t.Error("handler was not invoked for notification")
+	}
+}
+
+func TestHandleUnknownMethod(t *testing.T) {
+	s := newTestServer()
+
+	raw := []byte(`{"jsonrpc":"2.0","method":"nope","id":1}`)
+	got := s.Handle(context.Background(), raw)
+
+	var resp Response
+	if err := json.Unmarshal(got, &resp); err != nil {
+		t.Fatalf("unmarshalling response: %v", err)
+	}
+	if resp.Error == nil || resp.Error.Code != CodeMethodNotFound {
+		t.Errorf("error = %+v, want code %d", resp.Error, CodeMethodNotFound)
+	}
+}
+
+func TestHandleInvalidRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		wantCode int
+	}{
+		{"not json", `not json`, CodeParseError},
+		{"empty body", ``, CodeParseError},
+		{"wrong version", `{"jsonrpc":"1.0","method":"echo","id":1}`, CodeInvalidRequest},
+		{"missing method", `{"jsonrpc":"2.0","id":1}`, CodeInvalidRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			got := s.Handle(context.Background(), []byte(tt.raw))
+
+			var resp Response
+			if err := json.Unmarshal(got, &resp); err != nil {
+				t.Fatalf("unmarshalling response: %v", err)
+			}
+			if resp.Error == nil || resp.Error.Code != tt.wantCode {
+				t.Errorf("error = %+v, want code %d", resp.Error, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	s := newTestServer()
+	s.Register("echo", func(ctx context.Context, params json.RawMessage) (any, *Error) {
+		return string(params), nil
+	})
+
+	raw := []byte(`[
+		{"jsonrpc":"2.0","method":"echo","params":"a","id":1},
+		{"jsonrpc":"2.0","method":"echo","params":"b"},
+		{"jsonrpc":"2.0","method":"nope","id":2}
+	]`)
+	got := s.Handle(context.Background(), raw)
+
+	var responses []Response
+	if err := json.Unmarshal(got, &responses); err != nil {
+		t.Fatalf("unmarshalling batch response: %v", err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("len(responses) = %d, want 2 (the notification should be suppressed)", len(responses))
+	}
+	if responses[0].Result != `"a"` {
+		t.Errorf("responses[0].Result = %v, want %q", responses[0].Result, `"a"`)
+	}
+	if responses[1].Error == nil || responses[1].Error.Code != CodeMethodNotFound {
+		t.Errorf("responses[1].Error = %+v, want code %d", responses[1].Error, CodeMethodNotFound)
+	}
+}
+
+func TestHandleEmptyBatch(t *testing.T) {
+	s := newTestServer()
+	got := s.Handle(context.Background(), []byte(`[]`))
+
+	var resp Response
+	if err := json.Unmarshal(got, &resp); err != nil {
+		t.Fatalf("unmarshalling response: %v", err)
+	}
+	if resp.Error == nil || resp.Error.Code != CodeInvalidRequest {
+		t.Errorf("error = %+v, want code %d", resp.Error, CodeInvalidRequest)
+	}
+}
+
+func TestHandleBatchOfOnlyNotifications(t *testing.T) {
+	s := newTestServer()
+	s.Register("echo", func(ctx context.Context, params json.RawMessage) (any, *Error) {
+		return nil, nil
+	})
+
+	raw := []byte(`[{"jsonrpc":"2.0","method":"echo"},{"jsonrpc":"2.0","method":"echo"}]`)
+	got := s.Handle(context.Background(), raw)
+
+	if got != nil {
+		t.Errorf("Handle(batch of notifications) = %q, want nil", got)
+	}
+}
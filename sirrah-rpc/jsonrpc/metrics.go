@@ -0,0 +1,79 @@
+package jsonrpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/flashbots/gramine-andromeda-revm/sirrah-rpc/metrics"
+)
+
+// Recorder is the subset of the handle returned by
+// metrics.MetricsServer.Float64Histogram that callers caching instruments
+// need. It's matched structurally rather than imported by name so callers
+// don't need to know the concrete histogram type. Exported because
+// httpserver caches its own pool instruments against the same interface.
+type Recorder interface {
+	Record(ctx context.Context, value float64)
+}
+
+// methodMetrics caches one instrument per (metric, method) pair so the hot
+// dispatch path only pays for a map lookup, not a fresh registration on
+// every call. metrics.MetricsServer has no notion of attribute labels, so
+// the method name is folded into the instrument name instead of being
+// attached as a label. Callers must pass an already-bounded method label
+// (dispatch uses Server.methodLabel, which collapses anything not in the
+// handler registry to "unknown") - this cache is never evicted, so an
+// unsanitized, attacker-controlled method string here would grow it
+// without bound.
+type methodMetrics struct {
+	srv *metrics.MetricsServer
+
+	mu    sync.Mutex
+	cache map[string]Recorder
+}
+
+// sharedMethodMetrics holds one methodMetrics per MetricsServer, so the
+// instrument cache outlives any single Server - httpserver builds a fresh
+// Server per HTTP request.
+var sharedMethodMetrics sync.Map // *metrics.MetricsServer -> *methodMetrics
+
+func newMethodMetrics(srv *metrics.MetricsServer) *methodMetrics {
+	m, _ := sharedMethodMetrics.LoadOrStore(srv, &methodMetrics{srv: srv, cache: make(map[string]Recorder)})
+	return m.(*methodMetrics)
+}
+
+func (m *methodMetrics) instrument(name, desc, uom string, buckets ...float64) Recorder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.cache[name]; ok {
+		return h
+	}
+	h := m.srv.Float64Histogram(name, desc, uom, buckets...)
+	m.cache[name] = h
+	return h
+}
+
+func (m *methodMetrics) recordLatency(method string, microseconds float64) {
+	name := fmt.Sprintf("rpc_server_latency_%s", method)
+	m.instrument(name, "JSON-RPC handler latency", metrics.UomMicroseconds, metrics.BucketsRequestDuration...).
+		Record(context.Background(), microseconds)
+}
+
+func (m *methodMetrics) recordRequestBytes(method string, size float64) {
+	name := fmt.Sprintf("rpc_server_request_bytes_%s", method)
+	m.instrument(name, "JSON-RPC request payload size", metrics.UomCount, metrics.BucketsPayloadSize...).
+		Record(context.Background(), size)
+}
+
+func (m *methodMetrics) recordResponseBytes(method string, size float64) {
+	name := fmt.Sprintf("rpc_server_response_bytes_%s", method)
+	m.instrument(name, "JSON-RPC response payload size", metrics.UomCount, metrics.BucketsPayloadSize...).
+		Record(context.Background(), size)
+}
+
+func (m *methodMetrics) recordError(method string, code int) {
+	name := fmt.Sprintf("rpc_server_errors_%s_%d", method, code)
+	m.instrument(name, "JSON-RPC handler error count", metrics.UomCount, metrics.BucketsSmallCount...).
+		Record(context.Background(), 1)
+}
@@ -0,0 +1,92 @@
+package jsonrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+type ctxKey int
+
+const (
+	traceCtxKey ctxKey = iota
+	loggerCtxKey
+)
+
+// TraceContext is a W3C trace-context (https://www.w3.org/TR/trace-context/)
+// propagated across the dispatcher boundary: a trace id shared by the whole
+// call chain, plus the id of whichever span most recently touched it.
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewTraceContext starts a fresh trace, used when a caller sends no
+// traceparent header of its own.
+func NewTraceContext() TraceContext {
+	return TraceContext{TraceID: randomHex(16), SpanID: randomHex(8)}
+}
+
+// ParseTraceparent decodes a W3C `traceparent` header value
+// (`version-traceid-parentid-flags`). ok is false if header isn't one we
+// recognize, in which case the caller should start a fresh trace instead.
+func ParseTraceparent(header string) (tc TraceContext, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceID: parts[1], SpanID: parts[2]}, true
+}
+
+// Traceparent formats tc back into a W3C `traceparent` header value.
+func (tc TraceContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", tc.TraceID, tc.SpanID)
+}
+
+func withTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceCtxKey, tc)
+}
+
+// TraceContextFromContext retrieves the TraceContext attached by
+// WithIncomingTraceparent, if any.
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceCtxKey).(TraceContext)
+	return tc, ok
+}
+
+// WithIncomingTraceparent attaches the TraceContext carried by an inbound
+// W3C `traceparent` header value to ctx, starting a fresh trace if header
+// is empty or doesn't parse. Callers should do this once per request,
+// before handing ctx to Server.Handle, and mirror TraceContextFromContext's
+// result back out as the response's own `traceparent` header.
+func WithIncomingTraceparent(ctx context.Context, header string) context.Context {
+	tc, ok := ParseTraceparent(header)
+	if !ok {
+		tc = NewTraceContext()
+	}
+	return withTraceContext(ctx, tc)
+}
+
+func withLogger(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey, log)
+}
+
+// LoggerFromContext returns the request-scoped logger dispatch attached to
+// ctx (tagged with trace_id/span_id/req_id/rpc.method), falling back to
+// fallback if ctx carries none - e.g. when called outside of a dispatched
+// request.
+func LoggerFromContext(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if log, ok := ctx.Value(loggerCtxKey).(*slog.Logger); ok {
+		return log
+	}
+	return fallback
+}